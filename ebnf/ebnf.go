@@ -0,0 +1,191 @@
+// Package ebnf compiles an EBNF grammar of terminal productions into a
+// lex.StateFn, so a lexer's token patterns can be declared instead of
+// hand-written as a chain of lexWord/lexSkipSpaces-style functions.
+package ebnf
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/zserge/lex"
+)
+
+// dfaState is a set of NFA states reached together; it is computed lazily
+// (subset construction on demand) and interned so repeat visits share the
+// same instance and transition cache.
+type dfaState struct {
+	set   map[*state]bool
+	trans map[rune]*dfaState
+}
+
+// root is a top-level production: one not referenced by any other
+// production, and therefore one of the alternatives matched directly
+// against the input.
+type root struct {
+	name string
+	end  *state
+	tok  lex.TokenType
+	skip bool
+}
+
+type compiled struct {
+	roots []root
+	start *dfaState
+	cache map[string]*dfaState
+}
+
+// Compile builds a StateFn from grammar that recognizes the productions
+// named in tokenMap, emitting the matching lex.TokenType via lex.Emit.
+// Productions not referenced by any other production but also absent from
+// tokenMap (e.g. whitespace or comments) are still matched, but are
+// discarded with lex.Ignore instead of emitted - that is how a production is
+// marked as "skip". Productions that only appear on the right-hand side of
+// other productions are helpers and are never matched on their own.
+//
+// At each position the StateFn advances over every root's automaton at
+// once and, on stall, backs up to the longest match seen (maximal munch),
+// preferring the earliest-declared root on a tie.
+func Compile(grammar io.Reader, tokenMap map[string]lex.TokenType) (lex.StateFn, error) {
+	prods, order, err := parse(grammar)
+	if err != nil {
+		return nil, err
+	}
+	refs := referenced(prods)
+
+	var c compiled
+	c.cache = map[string]*dfaState{}
+	var starts []*state
+	err = func() (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				err = e.(error)
+			}
+		}()
+		b := &builder{prods: prods}
+		for _, name := range order {
+			if refs[name] {
+				continue
+			}
+			start, end := b.compile(prods[name])
+			tok, ok := tokenMap[name]
+			c.roots = append(c.roots, root{name: name, end: end, tok: tok, skip: !ok})
+			starts = append(starts, start)
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if len(c.roots) == 0 {
+		return nil, errors.New("ebnf: grammar has no root productions")
+	}
+
+	c.start = c.intern(closure(starts))
+	return c.step, nil
+}
+
+func (c *compiled) intern(set map[*state]bool) *dfaState {
+	key := stateKey(set)
+	if d, ok := c.cache[key]; ok {
+		return d
+	}
+	d := &dfaState{set: set, trans: map[rune]*dfaState{}}
+	c.cache[key] = d
+	return d
+}
+
+func stateKey(set map[*state]bool) string {
+	ids := make([]int, 0, len(set))
+	for s := range set {
+		ids = append(ids, s.id)
+	}
+	sort.Ints(ids)
+	key := make([]byte, 0, len(ids)*4)
+	for i, id := range ids {
+		if i > 0 {
+			key = append(key, ',')
+		}
+		key = strconv.AppendInt(key, int64(id), 10)
+	}
+	return string(key)
+}
+
+// advance returns the dfaState reached from cur on rune r, or nil if no
+// root's automaton can consume r from cur.
+func (c *compiled) advance(cur *dfaState, r rune) *dfaState {
+	if d, ok := cur.trans[r]; ok {
+		return d
+	}
+	var next []*state
+	for s := range cur.set {
+		for _, e := range s.edges {
+			if r >= e.lo && r <= e.hi {
+				next = append(next, e.to)
+			}
+		}
+	}
+	var d *dfaState
+	if len(next) > 0 {
+		d = c.intern(closure(next))
+	}
+	cur.trans[r] = d
+	return d
+}
+
+// acceptedRoot returns the index of the earliest-declared root whose
+// automaton has reached its end state in cur, or -1 if none has.
+func (c *compiled) acceptedRoot(cur *dfaState) int {
+	for i, root := range c.roots {
+		if cur.set[root.end] {
+			return i
+		}
+	}
+	return -1
+}
+
+// step is the StateFn returned by Compile. It runs every root's automaton
+// over the input at once (maximal munch), emits or ignores the
+// longest-matching root, and returns itself to continue.
+func (c *compiled) step(l lex.Lexer) lex.StateFn {
+	cur := c.start
+	consumed := 0
+	acceptedIdx, acceptedAt := -1, 0
+
+	for {
+		r := l.Peek()
+		if r == lex.EOF {
+			break
+		}
+		next := c.advance(cur, r)
+		if next == nil {
+			break
+		}
+		l.Next()
+		cur = next
+		consumed++
+		if i := c.acceptedRoot(cur); i >= 0 {
+			acceptedIdx, acceptedAt = i, consumed
+		}
+	}
+	for consumed > acceptedAt {
+		l.Backup()
+		consumed--
+	}
+
+	if acceptedIdx < 0 {
+		if consumed == 0 && l.Peek() == lex.EOF {
+			return nil
+		}
+		return l.Errorf(lex.TokError, "ebnf: no production matches %q", l.Value())
+	}
+
+	r := c.roots[acceptedIdx]
+	if r.skip {
+		l.Ignore()
+	} else {
+		l.Emit(r.tok)
+	}
+	return c.step
+}
@@ -0,0 +1,101 @@
+package ebnf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zserge/lex"
+)
+
+const (
+	tokWord lex.TokenType = iota
+	tokNumber
+)
+
+const wordsGrammar = `
+Word = letter { letter } .
+Number = digit { digit } .
+letter = 'a' … 'z' | 'A' … 'Z' .
+digit = '0' … '9' .
+skip = { ' ' | '\t' | '\n' } .
+`
+
+func TestCompile(t *testing.T) {
+	start, err := Compile(strings.NewReader(wordsGrammar), map[string]lex.TokenType{
+		"Word":   tokWord,
+		"Number": tokNumber,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := lex.NewLexerString("foo 42 bar")
+	r := l.Start(start)
+
+	want := []struct {
+		typ lex.TokenType
+		val string
+	}{
+		{tokWord, "foo"},
+		{tokNumber, "42"},
+		{tokWord, "bar"},
+	}
+	for _, w := range want {
+		tok, ok := r.Next()
+		if !ok || tok.Type != w.typ || tok.Value != w.val {
+			t.Errorf("got %v %v, want %+v", tok, ok, w)
+		}
+	}
+	if tok, ok := r.Next(); ok {
+		t.Error("expected end of input, got", tok)
+	}
+}
+
+func TestCompileUndefinedProduction(t *testing.T) {
+	_, err := Compile(strings.NewReader(`Word = letter . `), map[string]lex.TokenType{"Word": tokWord})
+	if err == nil {
+		t.Error("expected an error for an undefined production")
+	}
+}
+
+func TestCompileRecursiveProduction(t *testing.T) {
+	_, err := Compile(strings.NewReader(`Word = Word 'a' . `), map[string]lex.TokenType{"Word": tokWord})
+	if err == nil {
+		t.Error("expected an error for a recursive production")
+	}
+}
+
+// TestCompileMaximalMunchAtEOF covers a root whose longest alternative
+// (LONG) stalls on EOF instead of a mismatching rune, forcing step to back
+// up to a shorter accepted root (SHORT) right at the end of input. That
+// backup must not strand the remaining input unread.
+func TestCompileMaximalMunchAtEOF(t *testing.T) {
+	const grammar = `
+LONG = 'a' 'b' 'c' .
+SHORT = 'a' .
+B = 'b' .
+`
+	start, err := Compile(strings.NewReader(grammar), map[string]lex.TokenType{
+		"LONG":  tokWord,
+		"SHORT": tokWord,
+		"B":     tokNumber,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := lex.NewLexerString("ab")
+	r := l.Start(start)
+
+	a, ok := r.Next()
+	if !ok || a.Value != "a" {
+		t.Error(a, ok)
+	}
+	b, ok := r.Next()
+	if !ok || b.Value != "b" {
+		t.Error(b, ok)
+	}
+	if tok, ok := r.Next(); ok {
+		t.Error("expected end of input, got", tok)
+	}
+}
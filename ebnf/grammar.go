@@ -0,0 +1,201 @@
+package ebnf
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"text/scanner"
+	"unicode/utf8"
+)
+
+// expr is a node in a parsed production's right-hand side.
+type expr interface{}
+
+type (
+	alt       []expr // a | b | c
+	seq       []expr // a b c
+	ref       string // reference to another production
+	lit       string // a literal string or character, matched verbatim
+	charRange struct{ lo, hi rune }
+	opt       struct{ e expr } // [ e ]: zero or one
+	rep       struct{ e expr } // { e }: zero or more
+)
+
+// parse reads a grammar in the dialect used by Go's exp/ebnf:
+//
+//	Production  = name "=" Expression "." .
+//	Expression  = Alternative { "|" Alternative } .
+//	Alternative = Term { Term } .
+//	Term        = name | string | char [ "…" char ] | "(" Expression ")" |
+//	              "[" Expression "]" | "{" Expression "}" .
+//
+// where string is a double-quoted literal and char a single-quoted one; only
+// chars form ranges.
+//
+// It returns the productions keyed by name, and the names in declaration
+// order.
+func parse(r io.Reader) (prods map[string]expr, order []string, err error) {
+	var p parser
+	p.sc.Init(r)
+	p.sc.Mode = scanner.ScanIdents | scanner.ScanStrings | scanner.ScanChars
+	p.sc.Error = func(_ *scanner.Scanner, msg string) {
+		err = fmt.Errorf("ebnf: %s", msg)
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err = e.(error)
+		}
+	}()
+
+	prods = map[string]expr{}
+	p.next()
+	for p.tok != scanner.EOF {
+		name := p.expectIdent()
+		p.expect('=')
+		e := p.expression()
+		p.expect('.')
+		if _, dup := prods[name]; dup {
+			panic(fmt.Errorf("ebnf: production %q redeclared", name))
+		}
+		prods[name] = e
+		order = append(order, name)
+	}
+	return prods, order, err
+}
+
+const ellipsis = '…'
+
+type parser struct {
+	sc  scanner.Scanner
+	tok rune
+}
+
+func (p *parser) next() {
+	p.tok = p.sc.Scan()
+}
+
+func (p *parser) expect(tok rune) {
+	if p.tok != tok {
+		panic(fmt.Errorf("ebnf: expected %q, got %q", tok, p.sc.TokenText()))
+	}
+	p.next()
+}
+
+func (p *parser) expectIdent() string {
+	if p.tok != scanner.Ident {
+		panic(fmt.Errorf("ebnf: expected an identifier, got %q", p.sc.TokenText()))
+	}
+	name := p.sc.TokenText()
+	p.next()
+	return name
+}
+
+func (p *parser) expression() expr {
+	a := p.alternative()
+	if p.tok != '|' {
+		return a
+	}
+	alts := alt{a}
+	for p.tok == '|' {
+		p.next()
+		alts = append(alts, p.alternative())
+	}
+	return alts
+}
+
+func (p *parser) alternative() expr {
+	var terms seq
+	for p.tok != '|' && p.tok != '.' && p.tok != ')' && p.tok != ']' && p.tok != '}' && p.tok != scanner.EOF {
+		terms = append(terms, p.term())
+	}
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	return terms
+}
+
+func (p *parser) term() expr {
+	switch p.tok {
+	case scanner.Ident:
+		name := p.sc.TokenText()
+		p.next()
+		return ref(name)
+	case scanner.String:
+		s := p.unquote()
+		p.next()
+		return lit(s)
+	case scanner.Char:
+		lo := p.unquoteRune()
+		p.next()
+		if p.tok == ellipsis {
+			p.next()
+			if p.tok != scanner.Char {
+				panic(fmt.Errorf("ebnf: expected a character after %q, got %q", "…", p.sc.TokenText()))
+			}
+			hi := p.unquoteRune()
+			p.next()
+			return charRange{lo, hi}
+		}
+		return charRange{lo, lo}
+	case '(':
+		p.next()
+		e := p.expression()
+		p.expect(')')
+		return e
+	case '[':
+		p.next()
+		e := p.expression()
+		p.expect(']')
+		return opt{e}
+	case '{':
+		p.next()
+		e := p.expression()
+		p.expect('}')
+		return rep{e}
+	default:
+		panic(fmt.Errorf("ebnf: unexpected token %q", p.sc.TokenText()))
+	}
+}
+
+func (p *parser) unquote() string {
+	s, err := strconv.Unquote(p.sc.TokenText())
+	if err != nil {
+		panic(fmt.Errorf("ebnf: invalid string literal: %v", err))
+	}
+	return s
+}
+
+func (p *parser) unquoteRune() rune {
+	r, _ := utf8.DecodeRuneInString(p.unquote())
+	return r
+}
+
+// referenced returns the set of production names that appear on the
+// right-hand side of some production. Names absent from this set are roots:
+// top-level patterns that Compile matches directly against the input.
+func referenced(prods map[string]expr) map[string]bool {
+	refs := map[string]bool{}
+	var walk func(expr)
+	walk = func(e expr) {
+		switch e := e.(type) {
+		case ref:
+			refs[string(e)] = true
+		case alt:
+			for _, s := range e {
+				walk(s)
+			}
+		case seq:
+			for _, s := range e {
+				walk(s)
+			}
+		case opt:
+			walk(e.e)
+		case rep:
+			walk(e.e)
+		}
+	}
+	for _, e := range prods {
+		walk(e)
+	}
+	return refs
+}
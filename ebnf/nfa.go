@@ -0,0 +1,128 @@
+package ebnf
+
+import "fmt"
+
+// state is an NFA state built by Thompson construction: it has epsilon
+// transitions (eps) and consuming transitions over a rune range (edges).
+type state struct {
+	id    int
+	eps   []*state
+	edges []edge
+}
+
+type edge struct {
+	lo, hi rune
+	to     *state
+}
+
+// builder turns a production's expr into an NFA fragment, inlining
+// references to other productions. It panics on undefined or (indirectly)
+// recursive productions, since those can't be compiled to a finite
+// automaton; Compile recovers the panic and reports it as an error.
+type builder struct {
+	prods   map[string]expr
+	visting map[string]bool
+	nextID  int
+}
+
+func (b *builder) newState() *state {
+	b.nextID++
+	return &state{id: b.nextID}
+}
+
+// compile returns the start and accepting end state of the NFA fragment for
+// e.
+func (b *builder) compile(e expr) (start, end *state) {
+	switch e := e.(type) {
+	case ref:
+		if b.visting[string(e)] {
+			panic(fmt.Errorf("ebnf: production %q is recursive", e))
+		}
+		sub, ok := b.prods[string(e)]
+		if !ok {
+			panic(fmt.Errorf("ebnf: undefined production %q", e))
+		}
+		if b.visting == nil {
+			b.visting = map[string]bool{}
+		}
+		b.visting[string(e)] = true
+		start, end = b.compile(sub)
+		delete(b.visting, string(e))
+		return start, end
+
+	case lit:
+		start = b.newState()
+		cur := start
+		for _, r := range string(e) {
+			next := b.newState()
+			cur.edges = append(cur.edges, edge{r, r, next})
+			cur = next
+		}
+		end = cur
+		return start, end
+
+	case charRange:
+		start, end = b.newState(), b.newState()
+		start.edges = append(start.edges, edge{e.lo, e.hi, end})
+		return start, end
+
+	case seq:
+		if len(e) == 0 {
+			start = b.newState()
+			return start, start
+		}
+		start, end = b.compile(e[0])
+		for _, sub := range e[1:] {
+			s, e := b.compile(sub)
+			end.eps = append(end.eps, s)
+			end = e
+		}
+		return start, end
+
+	case alt:
+		start, end = b.newState(), b.newState()
+		for _, sub := range e {
+			s, e := b.compile(sub)
+			start.eps = append(start.eps, s)
+			e.eps = append(e.eps, end)
+		}
+		return start, end
+
+	case opt:
+		subStart, subEnd := b.compile(e.e)
+		start, end = b.newState(), b.newState()
+		start.eps = append(start.eps, subStart, end)
+		subEnd.eps = append(subEnd.eps, end)
+		return start, end
+
+	case rep:
+		subStart, subEnd := b.compile(e.e)
+		start, end = b.newState(), b.newState()
+		start.eps = append(start.eps, subStart, end)
+		subEnd.eps = append(subEnd.eps, subStart, end)
+		return start, end
+
+	default:
+		panic(fmt.Errorf("ebnf: unhandled expr %T", e))
+	}
+}
+
+// closure returns the set of states reachable from states by epsilon
+// transitions alone (including states themselves).
+func closure(states []*state) map[*state]bool {
+	seen := map[*state]bool{}
+	var walk func(*state)
+	walk = func(s *state) {
+		if seen[s] {
+			return
+		}
+		seen[s] = true
+		for _, t := range s.eps {
+			walk(t)
+		}
+	}
+	for _, s := range states {
+		walk(s)
+	}
+	return seen
+}
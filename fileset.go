@@ -0,0 +1,151 @@
+package lex
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FileSet coordinates lexing of several source files, giving every Token a
+// Pos that is unique across the whole set. It is modeled on go/token's
+// FileSet: each File reserves a range of the shared offset space, so a Pos
+// can always be mapped back to the File (and line/column within it) that
+// produced it.
+type FileSet struct {
+	files []*File
+	base  int
+}
+
+// NewFileSet creates an empty FileSet.
+func NewFileSet() *FileSet {
+	return &FileSet{base: 1}
+}
+
+// AddFile reserves size+1 positions for a new file named name and returns it.
+// size should be at least the number of runes the file's reader will
+// produce; Position does not map positions past it to this file (it returns
+// the zero Position for them, or a position in the next file added).
+func (fs *FileSet) AddFile(name string, size int) *File {
+	f := &File{set: fs, name: name, base: fs.base, size: size, lines: []int{0}}
+	fs.base += size + 1
+	fs.files = append(fs.files, f)
+	return f
+}
+
+// File returns the file that owns position p, or nil if p falls outside
+// every file added to fs.
+func (fs *FileSet) File(p int) *File {
+	for _, f := range fs.files {
+		if p >= f.base && p <= f.base+f.size {
+			return f
+		}
+	}
+	return nil
+}
+
+// Position resolves a FileSet-wide Pos (as found on a Token lexed with
+// NewLexerInFile) into a filename, line and column.
+func (fs *FileSet) Position(p int) Position {
+	f := fs.File(p)
+	if f == nil {
+		return Position{}
+	}
+	return f.position(p - f.base)
+}
+
+// File represents a single source file registered with a FileSet.
+type File struct {
+	set   *FileSet
+	name  string
+	base  int
+	size  int
+	src   []rune
+	lines []int // offsets of the start of each line, lines[0] == 0
+}
+
+// Name returns the name the file was registered under.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Base returns the first Pos reserved for this file.
+func (f *File) Base() int {
+	return f.base
+}
+
+func (f *File) appendRune(r rune) {
+	f.src = append(f.src, r)
+	if r == '\n' {
+		f.lines = append(f.lines, len(f.src))
+	}
+}
+
+func (f *File) unappendRune() {
+	r := f.src[len(f.src)-1]
+	f.src = f.src[:len(f.src)-1]
+	if r == '\n' {
+		f.lines = f.lines[:len(f.lines)-1]
+	}
+}
+
+func (f *File) position(offset int) Position {
+	line := 0
+	for line+1 < len(f.lines) && f.lines[line+1] <= offset {
+		line++
+	}
+	return Position{
+		Filename: f.name,
+		Line:     line + 1,
+		Column:   offset - f.lines[line] + 1,
+		Offset:   offset,
+	}
+}
+
+// LineText returns the text of the given 1-based line, without its trailing
+// newline. It returns "" if line is out of range.
+func (f *File) LineText(line int) string {
+	if line < 1 || line > len(f.lines) {
+		return ""
+	}
+	start := f.lines[line-1]
+	end := len(f.src)
+	if line < len(f.lines) {
+		end = f.lines[line] - 1
+	}
+	return strings.TrimRight(string(f.src[start:end]), "\r")
+}
+
+// Position is the human-readable location a FileSet Pos resolves to.
+type Position struct {
+	Filename string
+	Line     int
+	Column   int
+	Offset   int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+// SourceSnippet returns the source line tok was lexed from, underlined with
+// a caret at tok's column, for gcc-style error reporting:
+//
+//	line of code
+//	    ^~~~
+//
+// It requires tok to have come from a lexer created with NewLexerInFile.
+func (tok *Token) SourceSnippet(fs *FileSet) string {
+	p := fs.Position(tok.Pos)
+	if p.Filename == "" {
+		return ""
+	}
+	line := fs.File(tok.Pos).LineText(p.Line)
+	width := len([]rune(tok.Value))
+	if width == 0 {
+		width = 1
+	}
+	col := p.Column - 1
+	if col < 0 {
+		col = 0
+	}
+	return fmt.Sprintf("%s\n%s^%s", line, strings.Repeat(" ", col), strings.Repeat("~", width-1))
+}
@@ -0,0 +1,53 @@
+package lex
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFileSetPosition(t *testing.T) {
+	fs := NewFileSet()
+	f := fs.AddFile("words.txt", 21)
+
+	lex := NewLexerInFile(f, bytes.NewBufferString("  foo bar\n    baz    "))
+	r := lex.Start(lexSkipSpaces)
+
+	r.Next() // foo
+
+	bar, _ := r.Next()
+	pos := fs.Position(bar.Pos)
+	if pos.Filename != "words.txt" || pos.Line != 1 || pos.Column != 7 {
+		t.Error(pos)
+	}
+
+	baz, _ := r.Next()
+	pos = fs.Position(baz.Pos)
+	if pos.Filename != "words.txt" || pos.Line != 2 || pos.Column != 5 {
+		t.Error(pos)
+	}
+	r.Next() // drain trailing spaces so the whole line has been read
+
+	if text := f.LineText(pos.Line); text != "    baz    " {
+		t.Errorf("LineText(%d) = %q", pos.Line, text)
+	}
+}
+
+func TestTokenSourceSnippet(t *testing.T) {
+	fs := NewFileSet()
+	f := fs.AddFile("words.txt", 9)
+
+	lex := NewLexerInFile(f, bytes.NewBufferString("foo bar"))
+	r := lex.Start(lexSkipSpaces)
+
+	foo, _ := r.Next()
+	for {
+		if _, ok := r.Next(); !ok {
+			break
+		}
+	}
+
+	snippet := foo.SourceSnippet(fs)
+	if snippet != "foo bar\n^~~" {
+		t.Errorf("SourceSnippet() = %q", snippet)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -63,11 +65,70 @@ type Lexer interface {
 	Peek() rune
 	Pos() int
 	Run(start StateFn) <-chan Token
+	Start(start StateFn) TokenReader
 	Value() string
+
+	// Accept consumes the next rune if it is in valid, reporting whether it
+	// did.
+	Accept(valid string) bool
+	// AcceptRun consumes a run of runes in valid, returning how many.
+	AcceptRun(valid string) int
+	// AcceptFunc consumes the next rune if pred reports true for it.
+	AcceptFunc(pred func(rune) bool) bool
+	// AcceptRunFunc consumes a run of runes for which pred reports true,
+	// returning how many.
+	AcceptRunFunc(pred func(rune) bool) int
+	// AcceptString consumes s in full if it matches what comes next,
+	// reporting whether it did. On a mismatch anywhere in s, it backs up
+	// every rune it looked ahead at, leaving the lexer where it found it.
+	AcceptString(s string) bool
+
+	// PushDelim records that an open delimiter (e.g. '(') was seen,
+	// expecting close (e.g. ')') to eventually balance it.
+	PushDelim(open, close rune)
+	// PopDelim balances the innermost open delimiter against close, the
+	// closing rune just read from the input. It returns an error if there
+	// is no open delimiter left to pop, or if close does not match the
+	// close rune the innermost PushDelim was given.
+	PopDelim(close rune) error
+	// Depth returns the total nesting depth across every open delimiter.
+	Depth() int
+	// DepthOf returns how many unclosed delimiters were pushed with the
+	// given open rune.
+	DepthOf(open rune) int
+	// EmitAtDepth emits t only if Depth() equals depth; otherwise it leaves
+	// the buffered value untouched, for grammars where a rune (e.g. a
+	// comma) is only a real token at one nesting depth.
+	EmitAtDepth(t TokenType, depth int)
+}
+
+// TokenReader pulls tokens one at a time, driving the state functions on the
+// caller's own goroutine instead of through a channel. Unlike Run, there is
+// no background goroutine to leak if the caller stops reading early.
+type TokenReader interface {
+	// Next returns the next token, or ok == false once the lexer is
+	// exhausted.
+	Next() (tok Token, ok bool)
+	// Peek returns the next token without consuming it.
+	Peek() (tok Token, ok bool)
+	// Unread pushes a token back, so the next Next() or Peek() returns it
+	// again. Tokens are pushed back onto a stack, last in first out.
+	Unread(tok Token)
+}
+
+// runeUnreader is what a lexer needs from its underlying buffer: read a
+// rune, unread it again, and drop everything before the current token's
+// start once it has been Emit'd or Ignore'd. bufreader and ringReader both
+// implement it, giving NewLexer and NewStreamLexer the same Lexer on top of
+// an unbounded or a bounded buffer respectively.
+type runeUnreader interface {
+	io.RuneReader
+	UnreadRune() error
+	Ignore()
 }
 
 type lexer struct {
-	r      *bufreader
+	r      runeUnreader
 	tokens chan Token
 	eof    bool
 	// currently bufferred value
@@ -75,9 +136,30 @@ type lexer struct {
 	// Position in the stream
 	pos      pos
 	tokenPos pos
-	prevPos  []pos
+	// history of every Next() call not yet Backup()'d, in order, so Backup
+	// can be called repeatedly to roll back arbitrarily many runes
+	history []readRecord
+	// pull mode: set by Start, appended to by EmitExtra and Errorf instead
+	// of sending to tokens. A single state fn call can Emit more than once,
+	// so this is a FIFO queue, not a single slot; tokenReader.Next drains it
+	// fully before calling state again.
+	pull    bool
+	pending []Token
+	// set by NewLexerInFile; offsets tokens into the FileSet and mirrors
+	// every rune read into file.src so File can reconstruct line text
+	file *File
+	// stack of open delimiters pushed by PushDelim, not yet popped
+	delims []delim
 }
 
+type delim struct {
+	open, close rune
+}
+
+// ErrUnbalanced is reported via Errorf when the input ends with one or more
+// delimiters pushed by PushDelim still unpopped.
+var ErrUnbalanced = errors.New("lex: unbalanced delimiters at end of input")
+
 func NewLexer(r io.Reader) Lexer {
 	return &lexer{
 		r:      newbufreader(r),
@@ -89,20 +171,55 @@ func NewLexerString(s string) Lexer {
 	return NewLexer(bytes.NewBufferString(s))
 }
 
+// NewStreamLexer is like NewLexer, but bounds memory use to roughly bufSize
+// runes instead of buffering the whole input: reading further than bufSize
+// runes past the start of the current token fails with ErrBufferFull. Call
+// Ignore or Emit often enough that no single token exceeds bufSize, and
+// source already lexed stays eligible for garbage collection.
+func NewStreamLexer(r io.Reader, bufSize int) Lexer {
+	return &lexer{
+		r:      newRingReader(r, bufSize),
+		tokens: make(chan Token, 0),
+	}
+}
+
+// NewLexerInFile is like NewLexer, but associates the lexer with f so that
+// every emitted Token's Pos is a FileSet-wide offset: f.set.Position(tok.Pos)
+// and tok.SourceSnippet(f.set) then work across the whole set of files.
+func NewLexerInFile(f *File, r io.Reader) Lexer {
+	lex := NewLexer(r).(*lexer)
+	lex.file = f
+	return lex
+}
+
+// readRecord remembers enough about one Next() call to undo it: the
+// position it was made from, and whether it actually consumed a rune from
+// the reader (false for the repeatable EOF pseudo-read).
+type readRecord struct {
+	pos  pos
+	real bool
+}
+
 func (lex *lexer) Next() rune {
 	if r, _, err := lex.r.ReadRune(); err != nil {
 		if err != io.EOF {
 			lex.Errorf(TokError, err.Error())
+		} else if !lex.eof && len(lex.delims) > 0 {
+			lex.Errorf(TokError, ErrUnbalanced.Error())
 		}
 		lex.value = append(lex.value, r)
+		lex.history = append(lex.history, readRecord{lex.pos, false})
 		lex.eof = true
 		return EOF
 	} else {
 		var prev pos
 		lex.pos.CopyTo(&prev)
 		lex.pos.Advance(r)
-		lex.prevPos = append(lex.prevPos, prev)
+		lex.history = append(lex.history, readRecord{prev, true})
 		lex.value = append(lex.value, r)
+		if lex.file != nil {
+			lex.file.appendRune(r)
+		}
 		return r
 	}
 }
@@ -114,11 +231,122 @@ func (lex *lexer) Peek() rune {
 }
 
 func (lex *lexer) Backup() {
-	lex.r.UnreadRune()
+	rec := lex.history[len(lex.history)-1]
+	lex.history = lex.history[:len(lex.history)-1]
 	lex.value = lex.value[0 : len(lex.value)-1]
-	prev := lex.prevPos[len(lex.prevPos)-1]
-	prev.CopyTo(&lex.pos)
-	lex.prevPos = lex.prevPos[:len(lex.prevPos)-1]
+	rec.pos.CopyTo(&lex.pos)
+	if rec.real {
+		lex.r.UnreadRune()
+		if lex.file != nil {
+			lex.file.unappendRune()
+		}
+	} else {
+		lex.eof = false
+	}
+}
+
+func (lex *lexer) Accept(valid string) bool {
+	if strings.ContainsRune(valid, lex.Next()) {
+		return true
+	}
+	lex.Backup()
+	return false
+}
+
+func (lex *lexer) AcceptRun(valid string) int {
+	n := 0
+	for strings.ContainsRune(valid, lex.Next()) {
+		n++
+	}
+	lex.Backup()
+	return n
+}
+
+func (lex *lexer) AcceptFunc(pred func(rune) bool) bool {
+	if pred(lex.Next()) {
+		return true
+	}
+	lex.Backup()
+	return false
+}
+
+func (lex *lexer) AcceptRunFunc(pred func(rune) bool) int {
+	n := 0
+	for pred(lex.Next()) {
+		n++
+	}
+	lex.Backup()
+	return n
+}
+
+func (lex *lexer) AcceptString(s string) bool {
+	matched := 0
+	for _, want := range s {
+		if lex.Next() != want {
+			for i := 0; i <= matched; i++ {
+				lex.Backup()
+			}
+			return false
+		}
+		matched++
+	}
+	return true
+}
+
+func (lex *lexer) PushDelim(open, close rune) {
+	lex.delims = append(lex.delims, delim{open, close})
+}
+
+func (lex *lexer) PopDelim(close rune) error {
+	if len(lex.delims) == 0 {
+		return errors.New("lex: no open delimiter to pop")
+	}
+	top := lex.delims[len(lex.delims)-1]
+	if top.close != close {
+		return fmt.Errorf("lex: expected %q to close %q, got %q", top.close, top.open, close)
+	}
+	lex.delims = lex.delims[:len(lex.delims)-1]
+	return nil
+}
+
+func (lex *lexer) Depth() int {
+	return len(lex.delims)
+}
+
+func (lex *lexer) DepthOf(open rune) int {
+	n := 0
+	for _, d := range lex.delims {
+		if d.open == open {
+			n++
+		}
+	}
+	return n
+}
+
+func (lex *lexer) EmitAtDepth(t TokenType, depth int) {
+	if lex.Depth() == depth {
+		lex.Emit(t)
+	}
+}
+
+// IsSpace reports whether r is a space, tab, newline or carriage return.
+func IsSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// IsLetter reports whether r is a letter, as defined by unicode.IsLetter.
+func IsLetter(r rune) bool {
+	return unicode.IsLetter(r)
+}
+
+// IsDigit reports whether r is a decimal digit.
+func IsDigit(r rune) bool {
+	return unicode.IsDigit(r)
+}
+
+// IsAlphaNumeric reports whether r is a letter, digit, or underscore.
+func IsAlphaNumeric(r rune) bool {
+	return r == '_' || IsLetter(r) || IsDigit(r)
 }
 
 // Line() returns current line number in the reader
@@ -136,6 +364,15 @@ func (lex *lexer) Pos() int {
 	return lex.pos.pos
 }
 
+// filePos turns a position local to this lexer's reader into a FileSet-wide
+// offset, if the lexer was created with NewLexerInFile.
+func (lex *lexer) filePos(p int) int {
+	if lex.file == nil {
+		return p
+	}
+	return lex.file.base + p
+}
+
 // Value() returns currently buffered token value
 func (lex *lexer) Value() string {
 	return string(lex.value)
@@ -145,6 +382,10 @@ func (lex *lexer) Value() string {
 func (lex *lexer) Ignore() {
 	lex.pos.CopyTo(&lex.tokenPos)
 	lex.value = []rune{}
+	// Nothing before the new token start can be Backup()'d to anymore, so
+	// drop it; this is also what keeps history from growing across the
+	// whole input instead of just the current token.
+	lex.history = lex.history[:0]
 	lex.r.Ignore()
 }
 
@@ -153,13 +394,23 @@ func (lex *lexer) Emit(t TokenType) {
 }
 
 func (lex *lexer) EmitExtra(t TokenType, extra interface{}) {
-	lex.tokens <- Token{t, lex.Value(), lex.tokenPos.line, lex.tokenPos.col, lex.tokenPos.pos, extra}
+	tok := Token{t, lex.Value(), lex.tokenPos.line, lex.tokenPos.col, lex.filePos(lex.tokenPos.pos), extra}
+	if lex.pull {
+		lex.pending = append(lex.pending, tok)
+	} else {
+		lex.tokens <- tok
+	}
 	lex.Ignore()
 }
 
 func (lex *lexer) Errorf(t TokenType, s string, args ...interface{}) StateFn {
 	value := fmt.Sprintf(s, args...)
-	lex.tokens <- Token{t, value, lex.Line(), lex.Col(), lex.Pos(), nil}
+	tok := Token{t, value, lex.Line(), lex.Col(), lex.filePos(lex.Pos()), nil}
+	if lex.pull {
+		lex.pending = append(lex.pending, tok)
+	} else {
+		lex.tokens <- tok
+	}
 	return nil
 }
 
@@ -173,6 +424,59 @@ func (lex *lexer) Run(start StateFn) <-chan Token {
 	return lex.tokens
 }
 
+// Start begins a pull-based lexing session: state functions run on the
+// caller's goroutine as tokens are requested from the returned TokenReader,
+// instead of eagerly on a background goroutine.
+func (lex *lexer) Start(start StateFn) TokenReader {
+	lex.pull = true
+	return &tokenReader{lex: lex, state: start}
+}
+
+type tokenReader struct {
+	lex    *lexer
+	state  StateFn
+	done   bool
+	unread []Token
+}
+
+func (tr *tokenReader) Next() (Token, bool) {
+	if n := len(tr.unread); n > 0 {
+		tok := tr.unread[n-1]
+		tr.unread = tr.unread[:n-1]
+		return tok, true
+	}
+	if n := len(tr.lex.pending); n > 0 {
+		tok := tr.lex.pending[0]
+		tr.lex.pending = tr.lex.pending[1:]
+		return tok, true
+	}
+	if tr.done {
+		return Token{}, false
+	}
+	for tr.state != nil && !tr.lex.eof {
+		tr.state = tr.state(tr.lex)
+		if len(tr.lex.pending) > 0 {
+			tok := tr.lex.pending[0]
+			tr.lex.pending = tr.lex.pending[1:]
+			return tok, true
+		}
+	}
+	tr.done = true
+	return Token{}, false
+}
+
+func (tr *tokenReader) Peek() (Token, bool) {
+	tok, ok := tr.Next()
+	if ok {
+		tr.Unread(tok)
+	}
+	return tok, ok
+}
+
+func (tr *tokenReader) Unread(tok Token) {
+	tr.unread = append(tr.unread, tok)
+}
+
 type bufreader struct {
 	r   *bufio.Reader
 	buf []rune
@@ -186,14 +490,14 @@ func newbufreader(r io.Reader) *bufreader {
 
 // Reads rune from reader or from a buffer
 func (br *bufreader) ReadRune() (rune, int, error) {
-	if br.err != nil {
-		return 0, 0, br.err
-	}
 	if br.pos < len(br.buf) {
 		c := br.buf[br.pos]
 		br.pos++
 		return c, utf8.RuneLen(c), nil
 	}
+	if br.err != nil {
+		return 0, 0, br.err
+	}
 	c, size, err := br.r.ReadRune()
 	if err != nil {
 		br.err = err
@@ -204,19 +508,81 @@ func (br *bufreader) ReadRune() (rune, int, error) {
 	return c, size, err
 }
 
-// Rewinds the position in the buffer
+// Rewinds the position in the buffer by one rune. It can be called
+// repeatedly to roll back arbitrarily many runes, as long as they are still
+// held in buf (i.e. haven't been dropped by Ignore).
 func (br *bufreader) UnreadRune() error {
-	br.pos--
-	if br.pos < 0 {
+	if br.pos <= 0 {
 		return errors.New("reader position is out of bounds")
 	}
+	br.pos--
 	return nil
 }
 
-// Leaves only on buffered character in the buffer
+// Ignore drops every rune already consumed from the buffer, keeping
+// whatever was read but then UnreadRune'd (possibly more than one rune, if
+// the caller backed up several times) so it can still be read again.
 func (br *bufreader) Ignore() {
+	br.buf = br.buf[br.pos:]
 	br.pos = 0
-	if len(br.buf) > 0 {
-		br.buf = br.buf[len(br.buf)-1:]
+}
+
+// ErrBufferFull is returned by a stream lexer (NewStreamLexer) when a token
+// grows past its buffer's capacity without being Emit'd or Ignore'd.
+var ErrBufferFull = errors.New("lex: buffer full, increase stream buffer size")
+
+// ringReader is a runeUnreader backed by a fixed-size ring buffer instead of
+// an ever-growing slice. It holds only the runes between the current token's
+// mark (the position of the oldest rune that hasn't yet been Ignore'd) and
+// the read cursor; reading further once that window fills the whole ring
+// fails with ErrBufferFull rather than growing it.
+type ringReader struct {
+	r     *bufio.Reader
+	buf   []rune
+	mark  int // index in buf of the oldest rune held (the token start)
+	count int // number of valid runes in buf, starting at mark
+	pos   int // read cursor, as an offset from mark; 0 <= pos <= count
+	err   error
+}
+
+func newRingReader(r io.Reader, bufSize int) *ringReader {
+	return &ringReader{r: bufio.NewReader(r), buf: make([]rune, bufSize)}
+}
+
+func (rr *ringReader) ReadRune() (rune, int, error) {
+	if rr.pos < rr.count {
+		c := rr.buf[(rr.mark+rr.pos)%len(rr.buf)]
+		rr.pos++
+		return c, utf8.RuneLen(c), nil
+	}
+	if rr.err != nil {
+		return 0, 0, rr.err
+	}
+	if rr.count == len(rr.buf) {
+		return 0, 0, ErrBufferFull
+	}
+	c, size, err := rr.r.ReadRune()
+	if err != nil {
+		rr.err = err
+		return 0, 0, err
 	}
+	rr.buf[(rr.mark+rr.count)%len(rr.buf)] = c
+	rr.count++
+	rr.pos++
+	return c, size, nil
+}
+
+func (rr *ringReader) UnreadRune() error {
+	if rr.pos <= 0 {
+		return errors.New("reader position is out of bounds")
+	}
+	rr.pos--
+	return nil
+}
+
+// Ignore moves the mark up to the read cursor, freeing the runes before it.
+func (rr *ringReader) Ignore() {
+	rr.mark = (rr.mark + rr.pos) % len(rr.buf)
+	rr.count -= rr.pos
+	rr.pos = 0
 }
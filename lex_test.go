@@ -2,6 +2,7 @@ package lex
 
 import (
 	"errors"
+	"strings"
 	"testing"
 )
 
@@ -13,21 +14,23 @@ func isSpace(r rune) bool {
 	return r == ' ' || r == '\t' || r == '\r' || r == '\n'
 }
 
-func lexWord(lex *Lexer) StateFn {
+func lexWord(lex Lexer) StateFn {
 	for {
 		r := lex.Peek()
 		if isSpace(r) {
 			lex.Emit(TokWord)
 			return lexSkipSpaces
 		} else if r == EOF {
-			lex.Emit(TokWord)
+			if lex.Value() != "" {
+				lex.Emit(TokWord)
+			}
 			return nil
 		}
 		lex.Next()
 	}
 }
 
-func lexSkipSpaces(lex *Lexer) StateFn {
+func lexSkipSpaces(lex Lexer) StateFn {
 	for isSpace(lex.Next()) {
 	}
 	lex.Backup()
@@ -59,6 +62,300 @@ func TestWordReader(t *testing.T) {
 	}
 }
 
+func TestTokenReader(t *testing.T) {
+	lex := NewLexerString("  foo bar\n    baz    ")
+	r := lex.Start(lexSkipSpaces)
+
+	foo, ok := r.Next()
+	if !ok || foo.Value != "foo" || foo.Line != 0 || foo.Col != 2 || foo.Pos != 2 {
+		t.Error(foo, ok)
+	}
+
+	if peeked, ok := r.Peek(); !ok || peeked.Value != "bar" {
+		t.Error(peeked, ok)
+	}
+
+	bar, ok := r.Next()
+	if !ok || bar.Value != "bar" || bar.Line != 0 || bar.Col != 6 || bar.Pos != 6 {
+		t.Error(bar, ok)
+	}
+
+	r.Unread(bar)
+	if again, ok := r.Next(); !ok || again != bar {
+		t.Error(again, ok)
+	}
+
+	baz, ok := r.Next()
+	if !ok || baz.Value != "baz" || baz.Line != 1 || baz.Col != 4 || baz.Pos != 14 {
+		t.Error(baz, ok)
+	}
+
+	if tok, ok := r.Next(); ok {
+		t.Error("reader should be exhausted, but got", tok)
+	}
+}
+
+// lexLetterDigit emits twice per call: once for a run of letters, once for
+// the run of digits right after it, with no intervening call back into the
+// driver loop. TestTokenReaderMultiEmit exists to make sure Start doesn't
+// drop the first of the two.
+func lexLetterDigit(lex Lexer) StateFn {
+	lex.AcceptRunFunc(IsLetter)
+	lex.Emit(TokWord)
+	lex.AcceptRunFunc(IsDigit)
+	lex.Emit(TokWord)
+	if lex.Peek() == EOF {
+		return nil
+	}
+	return lexLetterDigit
+}
+
+func TestTokenReaderMultiEmit(t *testing.T) {
+	lex := NewLexerString("foo123")
+	r := lex.Start(lexLetterDigit)
+
+	foo, ok := r.Next()
+	if !ok || foo.Value != "foo" {
+		t.Error(foo, ok)
+	}
+
+	num, ok := r.Next()
+	if !ok || num.Value != "123" {
+		t.Error(num, ok)
+	}
+
+	if tok, ok := r.Next(); ok {
+		t.Error("reader should be exhausted, but got", tok)
+	}
+}
+
+// TestAcceptStringRollbackUnsticksEOF covers a mismatch whose lookahead runs
+// past EOF, then drives the lexer across several more state-fn invocations
+// through Run's own "!lex.eof" loop guard. A mismatch that never reaches EOF
+// wouldn't touch that guard at all, so TestAcceptStringMismatch doesn't cover
+// this: the failed AcceptString must leave the lexer able to keep producing
+// tokens, not stuck at eof forever.
+func lexEachRune(lex Lexer) StateFn {
+	if lex.Next() == EOF {
+		return nil
+	}
+	lex.Emit(TokWord)
+	return lexEachRune
+}
+
+func TestAcceptStringRollbackUnsticksEOF(t *testing.T) {
+	lex := NewLexerString("xy")
+	if lex.AcceptString("xyz") {
+		t.Fatal("expected 'xyz' not to match 'xy'")
+	}
+
+	c := lex.Run(lexEachRune)
+
+	x := <-c
+	if x.Value != "x" {
+		t.Error(x)
+	}
+	y := <-c
+	if y.Value != "y" {
+		t.Error(y)
+	}
+	if tok, ok := <-c; ok {
+		t.Error("expected end of input, got", tok)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	lex := NewLexerString("3.14 + x_1")
+
+	if n := lex.AcceptRunFunc(IsDigit); n != 1 {
+		t.Error(n)
+	}
+	if !lex.Accept(".") {
+		t.Error("expected '.' to be accepted")
+	}
+	if n := lex.AcceptRun("0123456789"); n != 2 {
+		t.Error(n)
+	}
+	if lex.Accept("x") {
+		t.Error("'x' should not be accepted at a space")
+	}
+	if lex.Value() != "3.14" {
+		t.Error(lex.Value())
+	}
+	lex.Ignore()
+
+	if !lex.AcceptString(" + ") {
+		t.Error("expected ' + ' to match")
+	}
+	lex.Ignore()
+
+	if n := lex.AcceptRunFunc(IsAlphaNumeric); n != 3 {
+		t.Error(n)
+	}
+	if lex.Value() != "x_1" {
+		t.Error(lex.Value())
+	}
+}
+
+func TestAcceptStringMismatch(t *testing.T) {
+	lex := NewLexerString("food")
+
+	if lex.AcceptString("foo!") {
+		t.Error("expected 'foo!' not to match 'food'")
+	}
+	if !lex.AcceptString("food") {
+		t.Error("expected 'food' to still be readable after the failed match")
+	}
+}
+
+// TestAcceptStringMismatchAtEOF covers a mismatch whose lookahead runs past
+// the end of input, unlike TestAcceptStringMismatch above where the
+// mismatching rune is read well before EOF. Backing up over the EOF read
+// must leave the buffered "foo" just as readable as a mismatch that never
+// touches EOF.
+func TestAcceptStringMismatchAtEOF(t *testing.T) {
+	lex := NewLexerString("foo")
+
+	if lex.AcceptString("food") {
+		t.Error("expected 'food' not to match 'foo'")
+	}
+	if n := lex.AcceptRunFunc(IsLetter); n != 3 || lex.Value() != "foo" {
+		t.Error(n, lex.Value())
+	}
+}
+
+func TestStreamLexer(t *testing.T) {
+	lex := NewStreamLexer(strings.NewReader("  foo bar\n    baz    "), 8)
+	r := lex.Start(lexSkipSpaces)
+
+	foo, _ := r.Next()
+	if foo.Value != "foo" {
+		t.Error(foo)
+	}
+	bar, _ := r.Next()
+	if bar.Value != "bar" {
+		t.Error(bar)
+	}
+	baz, _ := r.Next()
+	if baz.Value != "baz" {
+		t.Error(baz)
+	}
+	if tok, ok := r.Next(); ok {
+		t.Error("expected end of input, got", tok)
+	}
+}
+
+func TestStreamLexerBufferFull(t *testing.T) {
+	lex := NewStreamLexer(strings.NewReader("aaaaaaaaaaaaaaaa"), 4)
+	c := lex.Run(lexWord)
+
+	tok := <-c
+	if tok.Type != TokError || tok.Value != ErrBufferFull.Error() {
+		t.Error(tok)
+	}
+	for range c {
+	}
+}
+
+func TestDelimDepth(t *testing.T) {
+	lex := NewLexerString("([a])")
+
+	if d := lex.Depth(); d != 0 {
+		t.Error(d)
+	}
+
+	lex.Next() // (
+	lex.PushDelim('(', ')')
+	lex.Next() // [
+	lex.PushDelim('[', ']')
+	lex.Next() // a
+
+	if d := lex.Depth(); d != 2 {
+		t.Error(d)
+	}
+	if d := lex.DepthOf('('); d != 1 {
+		t.Error(d)
+	}
+	if d := lex.DepthOf('['); d != 1 {
+		t.Error(d)
+	}
+
+	lex.Next() // ]
+	if err := lex.PopDelim(']'); err != nil {
+		t.Error(err)
+	}
+	if d := lex.Depth(); d != 1 {
+		t.Error(d)
+	}
+
+	lex.Next() // )
+	if err := lex.PopDelim(')'); err != nil {
+		t.Error(err)
+	}
+	if d := lex.Depth(); d != 0 {
+		t.Error(d)
+	}
+
+	if err := lex.PopDelim(')'); err == nil {
+		t.Error("expected an error popping an empty delimiter stack")
+	}
+}
+
+func TestDelimMismatch(t *testing.T) {
+	lex := NewLexerString("(a]")
+
+	lex.Next() // (
+	lex.PushDelim('(', ')')
+	lex.Next() // a
+	lex.Next() // ]
+
+	if err := lex.PopDelim(']'); err == nil {
+		t.Error("expected an error popping '(' with a mismatched ']'")
+	}
+}
+
+func TestDelimEmitAtDepth(t *testing.T) {
+	lex := NewLexerString("abcd")
+	lex.Start(nil) // switch to pull mode, so Emit stashes the token instead of blocking on the channel
+	internal := lex.(*lexer)
+
+	lex.AcceptRunFunc(IsLetter)
+	lex.PushDelim('(', ')')
+	lex.EmitAtDepth(TokWord, 0)
+	if len(internal.pending) != 0 {
+		t.Error("EmitAtDepth emitted at the wrong depth:", internal.pending)
+	}
+
+	lex.PopDelim(')')
+	lex.EmitAtDepth(TokWord, 0)
+	if len(internal.pending) != 1 || internal.pending[0].Value != "abcd" {
+		t.Error("EmitAtDepth should have emitted \"abcd\" at depth 0:", internal.pending)
+	}
+}
+
+func TestUnbalancedDelim(t *testing.T) {
+	lex := NewLexerString("(a")
+	c := lex.Run(func(lex Lexer) StateFn {
+		for {
+			switch r := lex.Next(); r {
+			case '(':
+				lex.PushDelim('(', ')')
+			case EOF:
+				return nil
+			default:
+			}
+		}
+	})
+
+	var last Token
+	for tok := range c {
+		last = tok
+	}
+	if last.Type != TokError || last.Value != ErrUnbalanced.Error() {
+		t.Error(last)
+	}
+}
+
 type brokenReader struct{ data string }
 
 func (r *brokenReader) Read(p []byte) (int, error) {